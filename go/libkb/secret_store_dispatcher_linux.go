@@ -0,0 +1,268 @@
+// Copyright 2019 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+// +build linux
+
+package libkb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// linuxSecretBackendName identifies one of the backends
+// SecretStoreAllLinux can dispatch a user's secret to.
+type linuxSecretBackendName string
+
+const (
+	linuxSecretBackendSecretService linuxSecretBackendName = "secretservice"
+	linuxSecretBackendKernelKeyring linuxSecretBackendName = "kernel-keyring"
+	linuxSecretBackendFile          linuxSecretBackendName = "file"
+)
+
+// SecretStoreAllLinux is the top-level Linux SecretStoreAll. The freedesktop
+// Secret Service has no fallback of its own, so on headless servers and
+// minimal containers -- where nothing implements org.freedesktop.secrets --
+// NewService simply fails and Keybase is left with no secret store at all.
+// SecretStoreAllLinux instead probes, in order, the Secret Service over
+// D-Bus, the kernel session keyring, and finally an encrypted file under
+// $XDG_RUNTIME_DIR, remembering which backend each user ended up on so
+// later ClearSecret/GetUsersWithStoredSecrets calls know where to look.
+type SecretStoreAllLinux struct {
+	secretService *SecretStoreSecretService
+	kernelKeyring *SecretStoreKernelKeyring
+	file          *SecretStoreFile
+
+	assignmentsPath string
+	// assignmentsMu serializes the load-modify-save cycle every mutation of
+	// assignmentsPath goes through, so two concurrent callers (e.g. two
+	// users logging in around the same time) can't each read the same base
+	// map and clobber one another's write.
+	assignmentsMu sync.Mutex
+}
+
+var _ SecretStoreAll = (*SecretStoreAllLinux)(nil)
+
+func NewSecretStoreAllLinux(mctx MetaContext) *SecretStoreAllLinux {
+	return &SecretStoreAllLinux{
+		secretService:   NewSecretStoreSecretService(),
+		kernelKeyring:   NewSecretStoreKernelKeyring(),
+		file:            NewSecretStoreFile(secretStoreFileRuntimeDir()),
+		assignmentsPath: filepath.Join(mctx.G().Env.GetConfigDir(), "secretstore_backends.json"),
+	}
+}
+
+func (s *SecretStoreAllLinux) backend(name linuxSecretBackendName) SecretStoreAll {
+	switch name {
+	case linuxSecretBackendSecretService:
+		return s.secretService
+	case linuxSecretBackendKernelKeyring:
+		return s.kernelKeyring
+	case linuxSecretBackendFile:
+		return s.file
+	default:
+		return nil
+	}
+}
+
+// probeOrder is the order a brand new secret is tried against: the Secret
+// Service first since it's the most capable and most commonly available,
+// then the kernel keyring, then the file store as a last resort.
+func (s *SecretStoreAllLinux) probeOrder() []linuxSecretBackendName {
+	return []linuxSecretBackendName{
+		linuxSecretBackendSecretService,
+		linuxSecretBackendKernelKeyring,
+		linuxSecretBackendFile,
+	}
+}
+
+func (s *SecretStoreAllLinux) loadAssignments() (map[string]linuxSecretBackendName, error) {
+	assignments := make(map[string]linuxSecretBackendName)
+	raw, err := ioutil.ReadFile(s.assignmentsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return assignments, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &assignments); err != nil {
+		return nil, err
+	}
+	return assignments, nil
+}
+
+func (s *SecretStoreAllLinux) saveAssignments(assignments map[string]linuxSecretBackendName) error {
+	raw, err := json.Marshal(assignments)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.assignmentsPath), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.assignmentsPath, raw, 0600)
+}
+
+func (s *SecretStoreAllLinux) assignedBackend(username NormalizedUsername) (name linuxSecretBackendName, found bool, err error) {
+	assignments, err := s.loadAssignments()
+	if err != nil {
+		return "", false, err
+	}
+	name, found = assignments[string(username)]
+	return name, found, nil
+}
+
+// mutateAssignments runs mutate over the current on-disk assignment map and
+// persists the result, holding assignmentsMu for the whole load-modify-save
+// cycle so concurrent callers can't race each other into dropping a write.
+func (s *SecretStoreAllLinux) mutateAssignments(mutate func(assignments map[string]linuxSecretBackendName)) error {
+	s.assignmentsMu.Lock()
+	defer s.assignmentsMu.Unlock()
+	assignments, err := s.loadAssignments()
+	if err != nil {
+		return err
+	}
+	mutate(assignments)
+	return s.saveAssignments(assignments)
+}
+
+func (s *SecretStoreAllLinux) setAssignedBackend(username NormalizedUsername, name linuxSecretBackendName) error {
+	return s.mutateAssignments(func(assignments map[string]linuxSecretBackendName) {
+		assignments[string(username)] = name
+	})
+}
+
+func (s *SecretStoreAllLinux) RetrieveSecret(mctx MetaContext, username NormalizedUsername) (secret LKSecFullSecret, err error) {
+	defer mctx.TraceTimed("SecretStoreAllLinux.RetrieveSecret", func() error { return err })()
+
+	assigned, found, err := s.assignedBackend(username)
+	if err != nil {
+		return LKSecFullSecret{}, err
+	}
+	if found {
+		backend := s.backend(assigned)
+		if backend == nil {
+			return LKSecFullSecret{}, fmt.Errorf("unknown secret store backend %q", assigned)
+		}
+		return backend.RetrieveSecret(mctx, username)
+	}
+
+	var lastErr error
+	for _, candidate := range s.probeOrder() {
+		secret, err := s.backend(candidate).RetrieveSecret(mctx, username)
+		if err == nil {
+			if assignErr := s.setAssignedBackend(username, candidate); assignErr != nil {
+				mctx.Debug("SecretStoreAllLinux: failed to persist backend assignment: %s", assignErr)
+			}
+			return secret, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no secret backend available")
+	}
+	return LKSecFullSecret{}, lastErr
+}
+
+func (s *SecretStoreAllLinux) StoreSecret(mctx MetaContext, username NormalizedUsername, secret LKSecFullSecret) (err error) {
+	defer mctx.TraceTimed("SecretStoreAllLinux.StoreSecret", func() error { return err })()
+
+	if assigned, found, assignErr := s.assignedBackend(username); assignErr == nil && found {
+		if backend := s.backend(assigned); backend == nil {
+			mctx.Debug("SecretStoreAllLinux: assigned backend %q is unknown, reprobing", assigned)
+		} else if storeErr := backend.StoreSecret(mctx, username, secret); storeErr == nil {
+			return nil
+		} else {
+			mctx.Debug("SecretStoreAllLinux: previously assigned backend %q failed, reprobing", assigned)
+		}
+	}
+
+	var lastErr error
+	for _, candidate := range s.probeOrder() {
+		if storeErr := s.backend(candidate).StoreSecret(mctx, username, secret); storeErr == nil {
+			return s.setAssignedBackend(username, candidate)
+		} else {
+			lastErr = storeErr
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no secret backend available")
+	}
+	return lastErr
+}
+
+func (s *SecretStoreAllLinux) ClearSecret(mctx MetaContext, username NormalizedUsername) (err error) {
+	defer mctx.TraceTimed("SecretStoreAllLinux.ClearSecret", func() error { return err })()
+
+	assigned, found, err := s.assignedBackend(username)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	backend := s.backend(assigned)
+	if backend == nil {
+		return fmt.Errorf("unknown secret store backend %q", assigned)
+	}
+	if err := backend.ClearSecret(mctx, username); err != nil {
+		return err
+	}
+	return s.mutateAssignments(func(assignments map[string]linuxSecretBackendName) {
+		delete(assignments, string(username))
+	})
+}
+
+func (s *SecretStoreAllLinux) GetUsersWithStoredSecrets(mctx MetaContext) (usernames []string, err error) {
+	defer mctx.TraceTimed("SecretStoreAllLinux.GetUsersWithStoredSecrets", func() error { return err })()
+
+	assignments, err := s.loadAssignments()
+	if err != nil {
+		return nil, err
+	}
+	for username := range assignments {
+		usernames = append(usernames, username)
+	}
+	return usernames, nil
+}
+
+// MigrateTo copies username's secret into newBackend, switches the
+// dispatcher to use it, and clears the secret from wherever it used to
+// live. Callers reach for this when their environment changes -- e.g. a
+// Secret Service daemon becomes available on a host that was previously
+// falling back to the file store.
+func (s *SecretStoreAllLinux) MigrateTo(mctx MetaContext, username NormalizedUsername, newBackend linuxSecretBackendName) (err error) {
+	defer mctx.TraceTimed("SecretStoreAllLinux.MigrateTo", func() error { return err })()
+
+	dst := s.backend(newBackend)
+	if dst == nil {
+		return fmt.Errorf("unknown secret store backend %q", newBackend)
+	}
+
+	secret, err := s.RetrieveSecret(mctx, username)
+	if err != nil {
+		return err
+	}
+	if err := dst.StoreSecret(mctx, username, secret); err != nil {
+		return err
+	}
+
+	oldBackend, found, err := s.assignedBackend(username)
+	if err != nil {
+		return err
+	}
+	if err := s.setAssignedBackend(username, newBackend); err != nil {
+		return err
+	}
+	if found && oldBackend != newBackend {
+		if old := s.backend(oldBackend); old == nil {
+			mctx.Debug("SecretStoreAllLinux: assigned backend %q is unknown, skipping cleanup after migrating to %q", oldBackend, newBackend)
+		} else if err := old.ClearSecret(mctx, username); err != nil {
+			mctx.Debug("SecretStoreAllLinux: failed to clear %q after migrating to %q: %s", oldBackend, newBackend, err)
+		}
+	}
+	return nil
+}
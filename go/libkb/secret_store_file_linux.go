@@ -0,0 +1,153 @@
+// Copyright 2019 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+// +build linux
+
+package libkb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SecretStoreFile stores secrets AES-GCM-encrypted under
+// $XDG_RUNTIME_DIR/keybase/secrets, wrapped with a key generated on first
+// use and persisted alongside them (mode 0600). $XDG_RUNTIME_DIR is
+// tmpfs-backed and torn down at logout, so this is a session-scoped
+// fallback for systems with neither a Secret Service daemon nor a usable
+// kernel keyring, not durable storage.
+type SecretStoreFile struct {
+	dir string
+}
+
+var _ SecretStoreAll = (*SecretStoreFile)(nil)
+
+func NewSecretStoreFile(dir string) *SecretStoreFile {
+	return &SecretStoreFile{dir: dir}
+}
+
+// secretStoreFileRuntimeDir returns $XDG_RUNTIME_DIR/keybase/secrets, or ""
+// if $XDG_RUNTIME_DIR isn't set, in which case this backend isn't usable.
+func secretStoreFileRuntimeDir() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return ""
+	}
+	return filepath.Join(runtimeDir, "keybase", "secrets")
+}
+
+const secretStoreFileSuffix = ".secret"
+
+func (s *SecretStoreFile) wrapKeyPath() string {
+	return filepath.Join(s.dir, "wrap.key")
+}
+
+func (s *SecretStoreFile) secretPath(mctx MetaContext, username NormalizedUsername) string {
+	name := fmt.Sprintf("%s-%s%s", mctx.G().Env.GetStoredSecretServiceName(), username, secretStoreFileSuffix)
+	return filepath.Join(s.dir, name)
+}
+
+// wrapKey returns this store's AES-256 key, generating and persisting one
+// on first use.
+func (s *SecretStoreFile) wrapKey() ([]byte, error) {
+	if s.dir == "" {
+		return nil, fmt.Errorf("file secretstore unavailable: XDG_RUNTIME_DIR not set")
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create secret store directory")
+	}
+
+	encoded, err := ioutil.ReadFile(s.wrapKeyPath())
+	if err == nil {
+		return base64.StdEncoding.DecodeString(string(encoded))
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to read wrap key")
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(s.wrapKeyPath(), []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		return nil, errors.Wrap(err, "failed to persist wrap key")
+	}
+	return key, nil
+}
+
+func (s *SecretStoreFile) RetrieveSecret(mctx MetaContext, username NormalizedUsername) (secret LKSecFullSecret, err error) {
+	defer mctx.TraceTimed("SecretStoreFile.RetrieveSecret", func() error { return err })()
+
+	key, err := s.wrapKey()
+	if err != nil {
+		return LKSecFullSecret{}, err
+	}
+	sealed, err := ioutil.ReadFile(s.secretPath(mctx, username))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return LKSecFullSecret{}, fmt.Errorf("secret not found in file secretstore")
+		}
+		return LKSecFullSecret{}, errors.Wrap(err, "failed to read secret file")
+	}
+	plaintext, err := aesGCMOpen(key, sealed)
+	if err != nil {
+		return LKSecFullSecret{}, errors.Wrap(err, "failed to decrypt secret file")
+	}
+	return newLKSecFullSecretFromBytes(plaintext)
+}
+
+func (s *SecretStoreFile) StoreSecret(mctx MetaContext, username NormalizedUsername, secret LKSecFullSecret) (err error) {
+	defer mctx.TraceTimed("SecretStoreFile.StoreSecret", func() error { return err })()
+
+	key, err := s.wrapKey()
+	if err != nil {
+		return err
+	}
+	sealed, err := aesGCMSeal(key, secret.Bytes())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.secretPath(mctx, username), sealed, 0600)
+}
+
+func (s *SecretStoreFile) ClearSecret(mctx MetaContext, username NormalizedUsername) (err error) {
+	defer mctx.TraceTimed("SecretStoreFile.ClearSecret", func() error { return err })()
+
+	err = os.Remove(s.secretPath(mctx, username))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *SecretStoreFile) GetUsersWithStoredSecrets(mctx MetaContext) (usernames []string, err error) {
+	defer mctx.TraceTimed("SecretStoreFile.GetUsersWithStoredSecrets", func() error { return err })()
+
+	if s.dir == "" {
+		return nil, nil
+	}
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	prefix := mctx.G().Env.GetStoredSecretServiceName() + "-"
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, secretStoreFileSuffix) {
+			continue
+		}
+		username := strings.TrimSuffix(strings.TrimPrefix(name, prefix), secretStoreFileSuffix)
+		usernames = append(usernames, username)
+	}
+	return usernames, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+// +build linux
+
+package libkb
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// SecretStoreKernelKeyring stores secrets in the calling user's session
+// keyring, AES-GCM-wrapped under a key that is itself generated once and
+// kept in the same keyring. Unlike the Secret Service backend, this needs
+// no agent process running, which makes it usable on headless servers and
+// minimal containers. Like the session keyring itself, it doesn't survive
+// a reboot.
+type SecretStoreKernelKeyring struct{}
+
+var _ SecretStoreAll = (*SecretStoreKernelKeyring)(nil)
+
+func NewSecretStoreKernelKeyring() *SecretStoreKernelKeyring {
+	return &SecretStoreKernelKeyring{}
+}
+
+const keyringWrapKeyDescription = "keybase-secretstore-wrap-key"
+
+// wrapKey returns this store's AES-256 wrapping key, creating one in the
+// session keyring on first use.
+func (s *SecretStoreKernelKeyring) wrapKey() ([]byte, error) {
+	keyID, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user", keyringWrapKeyDescription, 0)
+	if err == nil {
+		key := make([]byte, 32)
+		n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, keyID, key, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read keyring wrap key")
+		}
+		return key[:n], nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := unix.AddKey("user", keyringWrapKeyDescription, key, unix.KEY_SPEC_SESSION_KEYRING); err != nil {
+		return nil, errors.Wrap(err, "failed to store keyring wrap key")
+	}
+	return key, nil
+}
+
+func secretKeyDescription(mctx MetaContext, username NormalizedUsername) string {
+	return fmt.Sprintf("keybase-secret-%s-%s", mctx.G().Env.GetStoredSecretServiceName(), username)
+}
+
+func (s *SecretStoreKernelKeyring) RetrieveSecret(mctx MetaContext, username NormalizedUsername) (secret LKSecFullSecret, err error) {
+	defer mctx.TraceTimed("SecretStoreKernelKeyring.RetrieveSecret", func() error { return err })()
+
+	key, err := s.wrapKey()
+	if err != nil {
+		return LKSecFullSecret{}, err
+	}
+	keyID, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user", secretKeyDescription(mctx, username), 0)
+	if err != nil {
+		return LKSecFullSecret{}, fmt.Errorf("secret not found in kernel keyring")
+	}
+	sealed := make([]byte, 4096)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, keyID, sealed, 0)
+	if err != nil {
+		return LKSecFullSecret{}, errors.Wrap(err, "failed to read secret from kernel keyring")
+	}
+	plaintext, err := aesGCMOpen(key, sealed[:n])
+	if err != nil {
+		return LKSecFullSecret{}, errors.Wrap(err, "failed to decrypt kernel keyring secret")
+	}
+	return newLKSecFullSecretFromBytes(plaintext)
+}
+
+func (s *SecretStoreKernelKeyring) StoreSecret(mctx MetaContext, username NormalizedUsername, secret LKSecFullSecret) (err error) {
+	defer mctx.TraceTimed("SecretStoreKernelKeyring.StoreSecret", func() error { return err })()
+
+	key, err := s.wrapKey()
+	if err != nil {
+		return err
+	}
+	sealed, err := aesGCMSeal(key, secret.Bytes())
+	if err != nil {
+		return err
+	}
+	if _, err := unix.AddKey("user", secretKeyDescription(mctx, username), sealed, unix.KEY_SPEC_SESSION_KEYRING); err != nil {
+		return errors.Wrap(err, "failed to store secret in kernel keyring")
+	}
+	return nil
+}
+
+func (s *SecretStoreKernelKeyring) ClearSecret(mctx MetaContext, username NormalizedUsername) (err error) {
+	defer mctx.TraceTimed("SecretStoreKernelKeyring.ClearSecret", func() error { return err })()
+
+	keyID, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user", secretKeyDescription(mctx, username), 0)
+	if err != nil {
+		return nil
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_REVOKE, keyID, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "failed to revoke kernel keyring secret")
+	}
+	// A revoked key stays linked into the session keyring -- and counts
+	// against the per-UID keyring quota -- until the kernel eventually
+	// garbage-collects it. Unlink it too so repeated store/clear cycles
+	// don't exhaust the quota.
+	if _, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, keyID, unix.KEY_SPEC_SESSION_KEYRING, 0, 0); err != nil {
+		mctx.Debug("SecretStoreKernelKeyring: failed to unlink revoked secret: %s", err)
+	}
+	return nil
+}
+
+// GetUsersWithStoredSecrets isn't supported by this backend: the kernel
+// keyring API has no "list keys matching this description prefix"
+// operation, only per-key lookup by exact description. Callers that need
+// an inventory should rely on the dispatcher's own bookkeeping instead.
+func (s *SecretStoreKernelKeyring) GetUsersWithStoredSecrets(mctx MetaContext) (usernames []string, err error) {
+	return nil, nil
+}
@@ -14,12 +14,56 @@ import (
 	"github.com/pkg/errors"
 )
 
-type SecretStoreSecretService struct{}
+// collectionAlias and collectionLabel name the dedicated collection this
+// store creates the first time the "default" alias isn't available. Many
+// systems don't create that alias until a keyring tool has been run at
+// least once.
+const collectionAlias = "keybase"
+const collectionLabel = "Keybase"
+
+// ReplacePolicy controls how SecretStoreSecretService resolves multiple
+// stored items matching the same (service, username) pair -- something that
+// can happen after a keyring migration or upgrade leaves stragglers behind.
+type ReplacePolicy int
+
+const (
+	// ReplaceMostRecent keeps the item with the newest Modified time and
+	// deletes the rest. This is the default.
+	ReplaceMostRecent ReplacePolicy = iota
+	// ReplaceAll deletes every matching item outright.
+	ReplaceAll
+	// FailOnConflict leaves duplicates untouched and returns an error.
+	FailOnConflict
+)
+
+func (p ReplacePolicy) String() string {
+	switch p {
+	case ReplaceMostRecent:
+		return "replace-most-recent"
+	case ReplaceAll:
+		return "replace-all"
+	case FailOnConflict:
+		return "fail-on-conflict"
+	default:
+		return fmt.Sprintf("ReplacePolicy(%d)", int(p))
+	}
+}
+
+type SecretStoreSecretService struct {
+	replacePolicy ReplacePolicy
+}
 
 var _ SecretStoreAll = (*SecretStoreSecretService)(nil)
 
 func NewSecretStoreSecretService() *SecretStoreSecretService {
-	return &SecretStoreSecretService{}
+	return &SecretStoreSecretService{replacePolicy: ReplaceMostRecent}
+}
+
+// SetReplacePolicy changes how future operations resolve duplicate stored
+// items. It is not safe to call concurrently with RetrieveSecret/
+// StoreSecret/ClearSecret.
+func (s *SecretStoreSecretService) SetReplacePolicy(policy ReplacePolicy) {
+	s.replacePolicy = policy
 }
 
 func (s *SecretStoreSecretService) makeServiceAttributes(mctx MetaContext) secsrv.Attributes {
@@ -36,125 +80,291 @@ func (s *SecretStoreSecretService) makeAttributes(mctx MetaContext, username Nor
 	return serviceAttributes
 }
 
-func (s *SecretStoreSecretService) maybeRetrieveSingleItem(mctx MetaContext, srv *secsrv.SecretService, username NormalizedUsername) (*dbus.ObjectPath, error) {
+// logProvider records which secretservice implementation we ended up
+// talking to, so quirky-provider bug reports (e.g. against KeePassXC) are
+// easier to diagnose.
+func (s *SecretStoreSecretService) logProvider(mctx MetaContext, srv *secsrv.SecretService) {
+	info := srv.ProviderInfo()
+	mctx.Debug("SecretStoreSecretService: using provider %q (quirks: %+v)", info.Quirks.Name, info.Quirks)
+}
+
+// withService opens a secretservice connection, hands it to fn, and closes
+// it (tearing down any sessions fn opened along the way) once fn returns,
+// regardless of outcome.
+func (s *SecretStoreSecretService) withService(mctx MetaContext, fn func(srv *secsrv.SecretService) error) (err error) {
+	srv, err := secsrv.NewService()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := srv.Close(); closeErr != nil {
+			mctx.Debug("SecretStoreSecretService: failed to close secretservice connection: %s", closeErr)
+		}
+	}()
+	s.logProvider(mctx, srv)
+	return fn(srv)
+}
+
+// openSession opens a secretservice session using the strongest
+// authentication mode the peer supports, falling back to plaintext only if
+// the DH-encrypted mode is rejected outright (e.g. an older or non-standard
+// secretservice implementation).
+func (s *SecretStoreSecretService) openSession(mctx MetaContext, srv *secsrv.SecretService) (*secsrv.Session, error) {
+	session, err := srv.OpenSession(secsrv.AuthenticationDHIETF1024SHA256AES128CBCPKCS7)
+	if err == nil {
+		return session, nil
+	}
+	mctx.Debug("SecretStoreSecretService: DH session negotiation failed (%s), falling back to plaintext", err)
+	return srv.OpenSession(secsrv.AuthenticationPlain)
+}
+
+// findExistingCollection returns the collection this store should use if
+// one already exists: the "default" alias, else a collection this store has
+// previously created and aliased to collectionAlias, else any collection
+// already labeled collectionLabel. It returns ok == false, with no error, if
+// none of those exist yet.
+func (s *SecretStoreSecretService) findExistingCollection(mctx MetaContext, srv *secsrv.SecretService) (path dbus.ObjectPath, ok bool, err error) {
+	if path, err := srv.ReadAlias("default"); err == nil && path != secsrv.NullPrompt {
+		return path, true, nil
+	}
+
+	if path, err := srv.ReadAlias(collectionAlias); err == nil && path != secsrv.NullPrompt {
+		return path, true, nil
+	}
+
+	if collections, err := srv.ListCollections(); err == nil {
+		for _, collection := range collections {
+			if label, err := srv.CollectionLabel(collection); err == nil && label == collectionLabel {
+				return collection, true, nil
+			}
+		}
+	}
+
+	return "", false, nil
+}
+
+// resolveCollection returns the collection this store should use, creating
+// one the first time none of the candidates findExistingCollection looks
+// for are present. This avoids hard failures on systems where the default
+// collection alias doesn't exist until a keyring tool has been run.
+func (s *SecretStoreSecretService) resolveCollection(mctx MetaContext, srv *secsrv.SecretService) (dbus.ObjectPath, error) {
+	if path, ok, err := s.findExistingCollection(mctx, srv); err != nil {
+		return "", err
+	} else if ok {
+		return path, nil
+	}
+
+	mctx.Debug("SecretStoreSecretService: no usable collection found, creating %q", collectionLabel)
+	collection, err := srv.CreateCollection(collectionLabel, collectionAlias)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create fallback collection")
+	}
+	return collection, nil
+}
+
+// resolveItem finds the item(s) matching (service, username) in collection
+// and, if there's more than one, resolves the conflict per s.replacePolicy.
+// It returns the surviving item, or nil if none remain.
+func (s *SecretStoreSecretService) resolveItem(mctx MetaContext, srv *secsrv.SecretService, collection dbus.ObjectPath, username NormalizedUsername) (*dbus.ObjectPath, error) {
 	if srv == nil {
 		return nil, fmt.Errorf("got nil d-bus secretservice")
 	}
-	items, err := srv.SearchCollection(secsrv.DefaultCollection, s.makeAttributes(mctx, username))
+	items, err := srv.SearchCollection(collection, s.makeAttributes(mctx, username))
 	if err != nil {
 		return nil, err
 	}
-	if len(items) < 1 { // TODO and if > 1? clear all..or something
+	if len(items) == 0 {
 		return nil, nil
 	}
-	item := items[0]
-	err = srv.Unlock([]dbus.ObjectPath{item})
-	if err != nil {
+	if err := srv.Unlock(items); err != nil {
 		return nil, err
 	}
-	return &item, nil
+	if len(items) == 1 {
+		return &items[0], nil
+	}
+
+	mctx.Debug("SecretStoreSecretService: found %d duplicate items for %s, resolving with %s", len(items), username, s.replacePolicy)
+	switch s.replacePolicy {
+	case FailOnConflict:
+		return nil, fmt.Errorf("found %d conflicting secretservice items for %s", len(items), username)
+	case ReplaceAll:
+		for _, item := range items {
+			if err := srv.DeleteItem(item); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case ReplaceMostRecent:
+		newest, stale, err := newestItem(srv, items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range stale {
+			if err := srv.DeleteItem(item); err != nil {
+				return nil, err
+			}
+		}
+		mctx.Debug("SecretStoreSecretService: deleted %d stale duplicate item(s) for %s", len(stale), username)
+		return &newest, nil
+	default:
+		return nil, fmt.Errorf("unknown replace policy %s", s.replacePolicy)
+	}
+}
+
+// newestItem returns the item with the latest Modified timestamp and the
+// rest, so callers can keep the former and delete the latter.
+func newestItem(srv *secsrv.SecretService, items []dbus.ObjectPath) (newest dbus.ObjectPath, stale []dbus.ObjectPath, err error) {
+	var newestModified uint64
+	for i, item := range items {
+		_, modified, err := srv.ItemTimestamps(item)
+		if err != nil {
+			return "", nil, err
+		}
+		if i == 0 || modified > newestModified {
+			if i > 0 {
+				stale = append(stale, newest)
+			}
+			newest, newestModified = item, modified
+		} else {
+			stale = append(stale, item)
+		}
+	}
+	return newest, stale, nil
 }
 
 func (s *SecretStoreSecretService) RetrieveSecret(mctx MetaContext, username NormalizedUsername) (secret LKSecFullSecret, err error) {
 	defer mctx.TraceTimed("SecretStoreSecretService.RetrieveSecret", func() error { return err })()
 
-	srv, err := secsrv.NewService()
-	if err != nil {
-		return LKSecFullSecret{}, err
-	}
-	session, err := srv.OpenSession(secsrv.AuthenticationPlain)
-	if err != nil {
-		return LKSecFullSecret{}, err
-	}
+	err = s.withService(mctx, func(srv *secsrv.SecretService) error {
+		session, err := s.openSession(mctx, srv)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
 
-	item, err := s.maybeRetrieveSingleItem(mctx, srv, username)
-	if err != nil {
-		return LKSecFullSecret{}, err
-	}
-	if item == nil {
-		return LKSecFullSecret{}, fmt.Errorf("secret not found in secretstore")
-	}
-	secretObj, err := srv.GetSecret(*item, session)
-	if err != nil {
-		return LKSecFullSecret{}, err
-	}
-	return newLKSecFullSecretFromBytes(secretObj.Value)
+		collection, err := s.resolveCollection(mctx, srv)
+		if err != nil {
+			return err
+		}
+		item, err := s.resolveItem(mctx, srv, collection, username)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			return fmt.Errorf("secret not found in secretstore")
+		}
+		secretBytes, err := srv.GetSecret(*item, *session)
+		if err != nil {
+			return err
+		}
+		secret, err = newLKSecFullSecretFromBytes(secretBytes)
+		return err
+	})
+	return secret, err
 }
 
 func (s *SecretStoreSecretService) StoreSecret(mctx MetaContext, username NormalizedUsername, secret LKSecFullSecret) (err error) {
 	defer mctx.TraceTimed("SecretStoreSecretService.StoreSecret", func() error { return err })()
 
-	srv, err := secsrv.NewService()
-	if err != nil {
-		return err
-	}
-	session, err := srv.OpenSession(secsrv.AuthenticationPlain)
-	if err != nil {
-		return err
-	}
-	label := fmt.Sprintf("%s@%s", username, mctx.G().Env.GetStoredSecretServiceName())
-	properties := secsrv.NewSecretProperties(label, s.makeAttributes(mctx, username))
-	srvSecret := secsrv.Secret{
-		Session:     session,
-		Parameters:  nil,
-		Value:       secret.Bytes(),
-		ContentType: "application/octet-stream",
-	}
-	err = srv.Unlock([]dbus.ObjectPath{secsrv.DefaultCollection})
-	if err != nil {
-		return err
-	}
-	_, err = srv.CreateItem(secsrv.DefaultCollection, properties, srvSecret, true /* replace existing secret */)
-	if err != nil {
-		return err
-	}
+	return s.withService(mctx, func(srv *secsrv.SecretService) error {
+		session, err := s.openSession(mctx, srv)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
 
-	return nil
+		collection, err := s.resolveCollection(mctx, srv)
+		if err != nil {
+			return err
+		}
+		if _, err := s.resolveItem(mctx, srv, collection, username); err != nil {
+			return err
+		}
+		label := fmt.Sprintf("%s@%s", username, mctx.G().Env.GetStoredSecretServiceName())
+		properties := secsrv.NewSecretProperties(label, s.makeAttributes(mctx, username))
+		srvSecret, err := session.NewSecret(secret.Bytes())
+		if err != nil {
+			return err
+		}
+		err = srv.Unlock([]dbus.ObjectPath{collection})
+		if err != nil {
+			return err
+		}
+		_, err = srv.CreateItem(collection, properties, srvSecret, true /* replace existing secret */)
+		return err
+	})
 }
 
 func (s *SecretStoreSecretService) ClearSecret(mctx MetaContext, username NormalizedUsername) (err error) {
 	defer mctx.TraceTimed("SecretStoreSecretService.ClearSecret", func() error { return err })()
 
-	srv, err := secsrv.NewService()
-	if err != nil {
-		return err
-	}
-	item, err := s.maybeRetrieveSingleItem(mctx, srv, username)
-	if err != nil {
-		return err
-	}
-	if item == nil {
-		mctx.Debug("secret not found; short-circuiting clear")
-		return nil
-	}
-	err = srv.DeleteItem(*item)
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.withService(mctx, func(srv *secsrv.SecretService) error {
+		collection, err := s.resolveCollection(mctx, srv)
+		if err != nil {
+			return err
+		}
+		item, err := s.resolveItem(mctx, srv, collection, username)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			mctx.Debug("secret not found; short-circuiting clear")
+			return nil
+		}
+		return srv.DeleteItem(*item)
+	})
 }
 
 func (s *SecretStoreSecretService) GetUsersWithStoredSecrets(mctx MetaContext) (usernames []string, err error) {
 	defer mctx.TraceTimed("SecretStoreSecretService.GetUsersWithStoredSecrets", func() error { return err })()
 
-	srv, err := secsrv.NewService()
+	itemsByUsername, err := s.ListItems(mctx)
 	if err != nil {
 		return nil, err
 	}
-	items, err := srv.SearchCollection(secsrv.DefaultCollection, s.makeServiceAttributes(mctx))
-	if err != nil {
-		return nil, err
+	for username := range itemsByUsername {
+		usernames = append(usernames, username)
 	}
-	for _, item := range items {
-		attributes, err := srv.GetAttributes(item)
+	return usernames, nil
+}
+
+// ListItems returns every item stored under this service's collection,
+// grouped by username, so operators can audit (and clean up) duplicates
+// left behind by the replace policy. It's read-only: on a system that has
+// never stored a secret, it returns an empty result rather than creating
+// (and possibly prompting for) a new collection.
+func (s *SecretStoreSecretService) ListItems(mctx MetaContext) (itemsByUsername map[string][]dbus.ObjectPath, err error) {
+	defer mctx.TraceTimed("SecretStoreSecretService.ListItems", func() error { return err })()
+
+	err = s.withService(mctx, func(srv *secsrv.SecretService) error {
+		collection, ok, err := s.findExistingCollection(mctx, srv)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		username, ok := attributes["username"]
 		if !ok {
-			return nil, errors.New("secret does not have username key")
+			itemsByUsername = make(map[string][]dbus.ObjectPath)
+			return nil
 		}
-		usernames = append(usernames, username)
-	}
-	return usernames, nil
+		items, err := srv.SearchCollection(collection, s.makeServiceAttributes(mctx))
+		if err != nil {
+			return err
+		}
+		itemsByUsername = make(map[string][]dbus.ObjectPath)
+		for _, item := range items {
+			attributes, err := srv.GetAttributes(item)
+			if err != nil {
+				return err
+			}
+			username, ok := attributes["username"]
+			if !ok {
+				return errors.New("secret does not have username key")
+			}
+			if itemType, err := srv.ItemType(item); err == nil && itemType != "" {
+				mctx.Debug("SecretStoreSecretService: item for %s has type %q", username, itemType)
+			}
+			itemsByUsername[username] = append(itemsByUsername[username], item)
+		}
+		return nil
+	})
+	return itemsByUsername, err
 }
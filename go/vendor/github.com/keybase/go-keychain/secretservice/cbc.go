@@ -0,0 +1,67 @@
+package secretservice
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// UnauthenticatedAESCBCEncrypt encrypts plaintext under key with AES-128-CBC,
+// generating a fresh random IV and PKCS7-padding the plaintext to the block
+// size. It provides no integrity protection of its own; the Secret Service
+// session algorithm relies on the local D-Bus transport for that, hence
+// "Unauthenticated".
+func UnauthenticatedAESCBCEncrypt(plaintext []byte, key []byte) (iv []byte, ciphertext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	iv = make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, nil, err
+	}
+	padded := pkcs7Pad(plaintext, aes.BlockSize)
+	ciphertext = make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	return iv, ciphertext, nil
+}
+
+// UnauthenticatedAESCBCDecrypt reverses UnauthenticatedAESCBCEncrypt.
+func UnauthenticatedAESCBCDecrypt(iv []byte, ciphertext []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("ciphertext is not a multiple of the block size")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return pkcs7Unpad(plaintext)
+}
+
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padLen := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data)+padLen)
+	copy(padded, data)
+	copy(padded[len(data):], bytes.Repeat([]byte{byte(padLen)}, padLen))
+	return padded
+}
+
+func pkcs7Unpad(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("cannot unpad empty data")
+	}
+	padLen := int(data[len(data)-1])
+	if padLen == 0 || padLen > len(data) {
+		return nil, fmt.Errorf("invalid pkcs7 padding")
+	}
+	for _, b := range data[len(data)-padLen:] {
+		if int(b) != padLen {
+			return nil, fmt.Errorf("invalid pkcs7 padding")
+		}
+	}
+	return data[:len(data)-padLen], nil
+}
@@ -0,0 +1,46 @@
+package secretservice
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnauthenticatedAESCBCRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+
+	cases := [][]byte{
+		[]byte("short"),
+		[]byte(""),
+		bytes.Repeat([]byte{0x7a}, 16),  // exactly one block
+		bytes.Repeat([]byte{0x7a}, 17),  // one block plus one byte
+		bytes.Repeat([]byte{0x7a}, 255), // multi-block
+	}
+
+	for _, plaintext := range cases {
+		iv, ciphertext, err := UnauthenticatedAESCBCEncrypt(plaintext, key)
+		if err != nil {
+			t.Fatalf("encrypt(%d bytes): %v", len(plaintext), err)
+		}
+		decrypted, err := UnauthenticatedAESCBCDecrypt(iv, ciphertext, key)
+		if err != nil {
+			t.Fatalf("decrypt(%d bytes): %v", len(plaintext), err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("round trip mismatch for %d bytes: got %x, want %x", len(plaintext), decrypted, plaintext)
+		}
+	}
+}
+
+func TestUnauthenticatedAESCBCDecryptRejectsBadPadding(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+	iv, ciphertext, err := UnauthenticatedAESCBCEncrypt([]byte("hello"), key)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	// Flipping the last IV byte flips the last plaintext byte, turning the
+	// 0x0b pad byte of "hello" into 0xf4, which is never valid padding.
+	iv[len(iv)-1] ^= 0xff
+	if _, err := UnauthenticatedAESCBCDecrypt(iv, ciphertext, key); err == nil {
+		t.Fatal("expected an error decrypting with a corrupted IV, got nil")
+	}
+}
@@ -0,0 +1,93 @@
+package secretservice
+
+import (
+	"fmt"
+
+	dbus "github.com/guelfey/go.dbus"
+	errors "github.com/pkg/errors"
+)
+
+// ReadAlias resolves a collection alias (e.g. "default") to the collection's
+// object path. If the alias is unset, the service replies with NullPrompt
+// ("/"), which is returned as is rather than as an error.
+func (s *SecretService) ReadAlias(alias string) (dbus.ObjectPath, error) {
+	var path dbus.ObjectPath
+	err := s.ServiceObj().
+		Call("org.freedesktop.Secret.Service.ReadAlias", NilFlags, alias).
+		Store(&path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read alias")
+	}
+	return path, nil
+}
+
+// SetAlias points alias at collection. Passing an empty collection path
+// removes the alias.
+func (s *SecretService) SetAlias(alias string, collection dbus.ObjectPath) error {
+	err := s.ServiceObj().
+		Call("org.freedesktop.Secret.Service.SetAlias", NilFlags, alias, collection).
+		Store()
+	if err != nil {
+		return errors.Wrap(err, "failed to set alias")
+	}
+	return nil
+}
+
+// ListCollections returns the object paths of every collection the service
+// currently knows about.
+func (s *SecretService) ListCollections() ([]dbus.ObjectPath, error) {
+	collectionsV, err := s.ServiceObj().GetProperty("org.freedesktop.Secret.Service.Collections")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list collections")
+	}
+	collections, ok := collectionsV.Value().([]dbus.ObjectPath)
+	if !ok {
+		return nil, fmt.Errorf("failed to coerce collections property to []dbus.ObjectPath")
+	}
+	return collections, nil
+}
+
+// CollectionLabel returns the human-readable label of a collection.
+func (s *SecretService) CollectionLabel(collection dbus.ObjectPath) (string, error) {
+	labelV, err := s.Obj(collection).GetProperty("org.freedesktop.Secret.Collection.Label")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get collection label")
+	}
+	label, ok := labelV.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("failed to coerce collection label to string")
+	}
+	return label, nil
+}
+
+// CreateCollection creates a new collection with the given label, optionally
+// pointing alias at it (pass "" for no alias), and waits out any unlock
+// prompt the service shows for the operation.
+func (s *SecretService) CreateCollection(label string, alias string) (dbus.ObjectPath, error) {
+	properties := map[string]dbus.Variant{
+		"org.freedesktop.Secret.Collection.Label": dbus.MakeVariant(label),
+	}
+	var collection dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	err := s.ServiceObj().
+		Call("org.freedesktop.Secret.Service.CreateCollection", NilFlags, properties, alias).
+		Store(&collection, &prompt)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create collection")
+	}
+	if collection == "" || collection == NullPrompt {
+		paths, err := s.PromptAndWait(prompt)
+		if err != nil {
+			return "", err
+		}
+		if paths != nil {
+			if p, ok := paths.Value().(dbus.ObjectPath); ok {
+				collection = p
+			}
+		}
+	}
+	if collection == "" {
+		return "", fmt.Errorf("secretservice did not return a collection path")
+	}
+	return collection, nil
+}
@@ -0,0 +1,86 @@
+package secretservice
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+)
+
+// Group is a finite cyclic group suitable for classic Diffie-Hellman key
+// exchange, as used by the freedesktop Secret Service
+// "dh-ietf1024-sha256-aes128-cbc-pkcs7" session algorithm.
+type Group struct {
+	p *big.Int
+	g *big.Int
+}
+
+// RFC2409SecondOakleyGroup returns the 1024-bit MODP group defined as the
+// "Second Oakley Group" in RFC 2409 section 6.2. This is the group the
+// Secret Service API's dh-ietf1024-sha256-aes128-cbc-pkcs7 algorithm is
+// specified against.
+func RFC2409SecondOakleyGroup() *Group {
+	p, ok := new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+			"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+			"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+			"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+			"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+			"FFFFFFFFFFFFFFFF", 16)
+	if !ok {
+		panic("secretservice: failed to parse RFC 2409 Second Oakley Group prime")
+	}
+	return &Group{p: p, g: big.NewInt(2)}
+}
+
+// NewKeypair generates a fresh private exponent x and the corresponding
+// public value y = g^x mod p.
+func (group *Group) NewKeypair() (private *big.Int, public *big.Int, err error) {
+	// Use a private exponent as wide as the modulus; RFC 2409 doesn't
+	// mandate a shorter one and the servers we talk to generate theirs
+	// the same way.
+	private, err = rand.Int(rand.Reader, group.p)
+	if err != nil {
+		return nil, nil, err
+	}
+	public = new(big.Int).Exp(group.g, private, group.p)
+	return private, public, nil
+}
+
+// KeygenHKDFSHA256AES128 computes the DH shared secret z = theirPublic^myPrivate
+// mod p and derives a 128-bit AES key from it via HKDF-SHA256 with an empty
+// salt and info, per the dh-ietf1024-sha256-aes128-cbc-pkcs7 algorithm.
+func (group *Group) KeygenHKDFSHA256AES128(theirPublic *big.Int, myPrivate *big.Int) ([]byte, error) {
+	z := new(big.Int).Exp(theirPublic, myPrivate, group.p)
+	ikm := leftPadBytes(z.Bytes(), (group.p.BitLen()+7)/8)
+	return hkdfSHA256Extract(ikm, 16), nil
+}
+
+func leftPadBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// hkdfSHA256Extract runs the RFC 5869 HKDF extract-then-expand schedule over
+// ikm with an empty salt and empty info, returning length bytes of output
+// keying material.
+func hkdfSHA256Extract(ikm []byte, length int) []byte {
+	extractor := hmac.New(sha256.New, make([]byte, sha256.Size)) // empty salt, zero-filled per RFC 5869
+	extractor.Write(ikm)
+	prk := extractor.Sum(nil)
+
+	okm := make([]byte, 0, length)
+	var previousBlock []byte
+	for counter := byte(1); len(okm) < length; counter++ {
+		expander := hmac.New(sha256.New, prk)
+		expander.Write(previousBlock) // empty info
+		expander.Write([]byte{counter})
+		previousBlock = expander.Sum(nil)
+		okm = append(okm, previousBlock...)
+	}
+	return okm[:length]
+}
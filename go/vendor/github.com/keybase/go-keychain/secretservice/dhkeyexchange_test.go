@@ -0,0 +1,57 @@
+package secretservice
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestKeygenHKDFSHA256AES128RoundTrip exercises two independently generated
+// keypairs agreeing on the same derived AES key, mirroring what OpenSession
+// does for the client and server halves of a dh-ietf1024-sha256-aes128-cbc-pkcs7
+// handshake.
+func TestKeygenHKDFSHA256AES128RoundTrip(t *testing.T) {
+	group := RFC2409SecondOakleyGroup()
+
+	clientPrivate, clientPublic, err := group.NewKeypair()
+	if err != nil {
+		t.Fatalf("client NewKeypair: %v", err)
+	}
+	serverPrivate, serverPublic, err := group.NewKeypair()
+	if err != nil {
+		t.Fatalf("server NewKeypair: %v", err)
+	}
+
+	clientKey, err := group.KeygenHKDFSHA256AES128(serverPublic, clientPrivate)
+	if err != nil {
+		t.Fatalf("client KeygenHKDFSHA256AES128: %v", err)
+	}
+	serverKey, err := group.KeygenHKDFSHA256AES128(clientPublic, serverPrivate)
+	if err != nil {
+		t.Fatalf("server KeygenHKDFSHA256AES128: %v", err)
+	}
+
+	if len(clientKey) != 16 {
+		t.Fatalf("expected a 128-bit key, got %d bytes", len(clientKey))
+	}
+	if !bytes.Equal(clientKey, serverKey) {
+		t.Fatalf("client and server derived different keys: %x != %x", clientKey, serverKey)
+	}
+}
+
+func TestLeftPadBytes(t *testing.T) {
+	cases := []struct {
+		in   []byte
+		size int
+		want []byte
+	}{
+		{[]byte{0x01}, 4, []byte{0x00, 0x00, 0x00, 0x01}},
+		{[]byte{0x01, 0x02, 0x03, 0x04}, 4, []byte{0x01, 0x02, 0x03, 0x04}},
+		{[]byte{}, 2, []byte{0x00, 0x00}},
+	}
+	for _, c := range cases {
+		got := leftPadBytes(c.in, c.size)
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("leftPadBytes(%x, %d) = %x, want %x", c.in, c.size, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package secretservice
+
+import (
+	"fmt"
+
+	dbus "github.com/guelfey/go.dbus"
+	errors "github.com/pkg/errors"
+)
+
+// ItemTimestamps returns an item's creation and last-modification times, as
+// reported by the org.freedesktop.Secret.Item.Created/.Modified properties
+// (seconds since the Unix epoch).
+func (s *SecretService) ItemTimestamps(item dbus.ObjectPath) (created uint64, modified uint64, err error) {
+	createdV, err := s.Obj(item).GetProperty("org.freedesktop.Secret.Item.Created")
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to get item created time")
+	}
+	modifiedV, err := s.Obj(item).GetProperty("org.freedesktop.Secret.Item.Modified")
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to get item modified time")
+	}
+	created, ok := createdV.Value().(uint64)
+	if !ok {
+		return 0, 0, fmt.Errorf("failed to coerce item created time to uint64")
+	}
+	modified, ok = modifiedV.Value().(uint64)
+	if !ok {
+		return 0, 0, fmt.Errorf("failed to coerce item modified time to uint64")
+	}
+	return created, modified, nil
+}
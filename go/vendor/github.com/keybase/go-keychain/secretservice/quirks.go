@@ -0,0 +1,59 @@
+package secretservice
+
+import "strings"
+
+// ProviderQuirks records capability differences we've observed between
+// Secret Service implementations in the wild, so callers can work around
+// them instead of failing outright.
+type ProviderQuirks struct {
+	// Name is a best-effort identifier for the detected provider, e.g.
+	// "libsecret" or "keepassxc". "unknown" if detection was inconclusive.
+	Name string
+	// NoItemType is set when the provider doesn't expose the
+	// org.freedesktop.Secret.Item.Type property (observed on KeePassXC's
+	// org.freedesktop.secrets implementation).
+	NoItemType bool
+}
+
+// ProviderInfo describes the Secret Service implementation a SecretService
+// is talking to.
+type ProviderInfo struct {
+	BusOwner string
+	Quirks   ProviderQuirks
+}
+
+// ProviderInfo returns the capability information detected for the peer at
+// NewService time.
+func (s *SecretService) ProviderInfo() ProviderInfo {
+	return ProviderInfo{BusOwner: s.busOwner, Quirks: s.quirks}
+}
+
+// detectProviderQuirks probes a running secretservice peer for known
+// compatibility gaps. Detection is best-effort and never fails: an
+// inconclusive result just means no quirks are assumed.
+func detectProviderQuirks(s *SecretService) (busOwner string, quirks ProviderQuirks) {
+	quirks.Name = "unknown"
+
+	var owner string
+	if err := s.conn.Object("org.freedesktop.DBus", "/org/freedesktop/DBus").
+		Call("org.freedesktop.DBus.GetNameOwner", NilFlags, SecretServiceInterface).
+		Store(&owner); err != nil {
+		return "", quirks
+	}
+
+	var introspectXML string
+	err := s.ServiceObj().
+		Call("org.freedesktop.DBus.Introspectable.Introspect", NilFlags).
+		Store(&introspectXML)
+	if err != nil {
+		return owner, quirks
+	}
+	if strings.Contains(strings.ToLower(introspectXML), "keepassxc") {
+		quirks.Name = "keepassxc"
+		quirks.NoItemType = true
+		return owner, quirks
+	}
+
+	quirks.Name = "libsecret"
+	return owner, quirks
+}
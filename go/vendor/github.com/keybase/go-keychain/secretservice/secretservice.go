@@ -36,7 +36,10 @@ type PromptCompletedResult struct {
 
 type SecretService struct {
 	conn     *dbus.Conn
-	signalCh <-chan *dbus.Signal
+	signalCh chan *dbus.Signal
+	busOwner string
+	quirks   ProviderQuirks
+	sessions []*Session
 }
 
 type Session struct {
@@ -45,6 +48,8 @@ type Session struct {
 	Public  *big.Int
 	Private *big.Int
 	AESKey  []byte
+
+	service *SecretService
 }
 
 func NewService() (*SecretService, error) {
@@ -54,7 +59,25 @@ func NewService() (*SecretService, error) {
 	}
 	signalCh := make(chan *dbus.Signal, 16)
 	conn.Signal(signalCh)
-	return &SecretService{conn: conn, signalCh: signalCh}, nil
+	s := &SecretService{conn: conn, signalCh: signalCh}
+	s.busOwner, s.quirks = detectProviderQuirks(s)
+	return s, nil
+}
+
+// Close tears down every session this SecretService opened, unsubscribes
+// its signal channel, and closes the underlying D-Bus connection. It is
+// safe to call once all outstanding calls on s have returned.
+func (s *SecretService) Close() (err error) {
+	for _, session := range s.sessions {
+		if closeErr := session.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.conn.RemoveSignal(s.signalCh)
+	if closeErr := s.conn.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func (s *SecretService) ServiceObj() *dbus.Object {
@@ -66,9 +89,9 @@ func (s *SecretService) Obj(path dbus.ObjectPath) *dbus.Object {
 }
 
 func (s *SecretService) OpenSession(mode authenticationMode) (session *Session, err error) {
-	var sessionAlgorithmInput dbus.Variant
+	session = &Session{Mode: mode, service: s}
 
-	session.Mode = mode
+	var sessionAlgorithmInput dbus.Variant
 
 	switch mode {
 	case AuthenticationPlain:
@@ -87,36 +110,49 @@ func (s *SecretService) OpenSession(mode authenticationMode) (session *Session,
 	}
 
 	var sessionAlgorithmOutput dbus.Variant
+	var sessionPath dbus.ObjectPath
 	err = s.ServiceObj().
 		Call("org.freedesktop.Secret.Service.OpenSession", NilFlags, mode, sessionAlgorithmInput).
-		Store(&sessionAlgorithmOutput, &session)
+		Store(&sessionAlgorithmOutput, &sessionPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open secretservice session")
 	}
+	if err := session.applyOpenSessionResponse(sessionPath, sessionAlgorithmOutput); err != nil {
+		return nil, err
+	}
 
-	switch mode {
+	s.sessions = append(s.sessions, session)
+	return session, nil
+}
+
+// applyOpenSessionResponse finishes negotiating session from the path and
+// algorithm-output variant OpenSession got back over D-Bus: for the
+// DH-encrypted mode, that means decoding the peer's public value and
+// deriving the shared AES key. It's split out from OpenSession so this
+// decoding -- where a past version of this code used UnmarshalText instead
+// of SetBytes on the raw big-endian value and silently derived the wrong
+// key -- can be exercised directly in tests without a live D-Bus connection.
+func (session *Session) applyOpenSessionResponse(sessionPath dbus.ObjectPath, sessionAlgorithmOutput dbus.Variant) error {
+	session.Path = sessionPath
+
+	switch session.Mode {
 	case AuthenticationPlain:
 	case AuthenticationDHIETF1024SHA256AES128CBCPKCS7:
 		theirPublicBigEndian, ok := sessionAlgorithmOutput.Value().([]byte)
 		if !ok {
-			return nil, fmt.Errorf("failed to coerce algorithm output value to byteslice")
+			return fmt.Errorf("failed to coerce algorithm output value to byteslice")
 		}
 		group := RFC2409SecondOakleyGroup()
-		theirPublic := new(big.Int)
-		err := theirPublic.UnmarshalText(theirPublicBigEndian)
-		if err != nil {
-			return nil, err
-		}
+		theirPublic := new(big.Int).SetBytes(theirPublicBigEndian) // y' is sent as a raw big-endian byteslice, not text
 		aesKey, err := group.KeygenHKDFSHA256AES128(theirPublic, session.Private)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		session.AESKey = aesKey
 	default:
-		return nil, fmt.Errorf("unknown authentication mode %v", mode)
+		return fmt.Errorf("unknown authentication mode %v", session.Mode)
 	}
-
-	return session, nil
+	return nil
 }
 
 func (s *SecretService) SearchCollection(collection dbus.ObjectPath, attributes Attributes) (items []dbus.ObjectPath, err error) {
@@ -130,6 +166,25 @@ func (s *SecretService) SearchCollection(collection dbus.ObjectPath, attributes
 }
 
 func (s *SecretService) CreateItem(collection dbus.ObjectPath, properties map[string]dbus.Variant, secret Secret, replace bool) (item dbus.ObjectPath, err error) {
+	item, err = s.createItem(collection, properties, secret, replace)
+	if err == nil || !s.quirks.NoItemType {
+		return item, err
+	}
+	if _, ok := properties["org.freedesktop.Secret.Item.Type"]; !ok {
+		return item, err
+	}
+	// Providers without the Item.Type property (e.g. KeePassXC) can reject
+	// CreateItem calls that set it; retry once without that property.
+	trimmed := make(map[string]dbus.Variant, len(properties)-1)
+	for k, v := range properties {
+		if k != "org.freedesktop.Secret.Item.Type" {
+			trimmed[k] = v
+		}
+	}
+	return s.createItem(collection, trimmed, secret, replace)
+}
+
+func (s *SecretService) createItem(collection dbus.ObjectPath, properties map[string]dbus.Variant, secret Secret, replace bool) (item dbus.ObjectPath, err error) {
 	var prompt dbus.ObjectPath
 	err = s.Obj(collection).
 		Call("org.freedesktop.Secret.Collection.CreateItem", NilFlags, properties, secret, replace).
@@ -164,11 +219,31 @@ func (s *SecretService) GetAttributes(item dbus.ObjectPath) (attributes Attribut
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get attributes for item")
 	}
-	attributes, ok := attributesV.Value().(Attributes)
-	if !ok {
-		return nil, errors.Wrap(err, "failed to coerce attributes variant")
+	switch v := attributesV.Value().(type) {
+	case Attributes:
+		return v, nil
+	case map[string]string:
+		// godbus decodes a{ss} as map[string]string, not our named
+		// Attributes type, so every reply read over D-Bus lands here.
+		return Attributes(v), nil
+	default:
+		return nil, fmt.Errorf("failed to coerce attributes variant of type %T", attributesV.Value())
 	}
-	return attributes, nil
+}
+
+// ItemType returns the item's org.freedesktop.Secret.Item.Type property.
+// Some providers (e.g. KeePassXC) don't expose this property at all; for
+// those, ItemType returns "" rather than an error.
+func (s *SecretService) ItemType(item dbus.ObjectPath) (string, error) {
+	typeV, err := s.Obj(item).GetProperty("org.freedesktop.Secret.Item.Type")
+	if err != nil {
+		if s.quirks.NoItemType {
+			return "", nil
+		}
+		return "", errors.Wrap(err, "failed to get item type")
+	}
+	itemType, _ := typeV.Value().(string)
+	return itemType, nil
 }
 
 func (s *SecretService) GetSecret(item dbus.ObjectPath, session Session) (secretPlaintext []byte, err error) {
@@ -179,9 +254,16 @@ func (s *SecretService) GetSecret(item dbus.ObjectPath, session Session) (secret
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get secret")
 	}
+	return decodeAndDecryptSecret(secretI, session)
+}
+
+// decodeAndDecryptSecret unmarshals the GetSecret reply struct and, for the
+// DH-encrypted mode, decrypts it under session.AESKey. It's split out from
+// GetSecret so this wiring can be exercised directly in tests without a
+// live D-Bus connection.
+func decodeAndDecryptSecret(secretI []interface{}, session Session) (secretPlaintext []byte, err error) {
 	secret := new(Secret)
-	err = dbus.Store(secretI, &secret.Session, &secret.Parameters, &secret.Value, &secret.ContentType)
-	if err != nil {
+	if err := dbus.Store(secretI, &secret.Session, &secret.Parameters, &secret.Value, &secret.ContentType); err != nil {
 		return nil, errors.Wrap(err, "failed to unmarshal get secret result")
 	}
 
@@ -191,7 +273,7 @@ func (s *SecretService) GetSecret(item dbus.ObjectPath, session Session) (secret
 	case AuthenticationDHIETF1024SHA256AES128CBCPKCS7:
 		plaintext, err := UnauthenticatedAESCBCDecrypt(secret.Parameters, secret.Value, session.AESKey)
 		if err != nil {
-			return nil, nil
+			return nil, errors.Wrap(err, "failed to decrypt secret")
 		}
 		secretPlaintext = plaintext
 	default:
@@ -212,11 +294,10 @@ func (s *SecretService) Unlock(items []dbus.ObjectPath) (err error) {
 	if err != nil {
 		return errors.Wrap(err, "failed to unlock items")
 	}
-	paths, err := s.PromptAndWait(prompt)
+	_, err = s.PromptAndWait(prompt)
 	if err != nil {
 		return errors.Wrap(err, "failed to prompt")
 	}
-	fmt.Println("unlocked paths %+v", paths)
 	return nil
 }
 
@@ -229,12 +310,9 @@ func (s *SecretService) LockItems(items []dbus.ObjectPath) (err error) {
 	if err != nil {
 		return errors.Wrap(err, "failed to lock items")
 	}
-	paths, err := s.PromptAndWait(prompt)
-	if err != nil {
+	if _, err := s.PromptAndWait(prompt); err != nil {
 		return errors.Wrap(err, "failed to prompt")
 	}
-	fmt.Printf("unlocked paths %+v\n", paths)
-
 	return nil
 }
 
@@ -246,20 +324,43 @@ func (p PromptDismissedError) Error() string {
 	return p.err.Error()
 }
 
+const promptInterface = "org.freedesktop.Secret.Prompt"
+
+// addPromptMatch subscribes the bus connection to Completed signals from
+// the given prompt object only, so PromptAndWait can't be woken by an
+// unrelated prompt completing (or dismissed) elsewhere on the session bus.
+func (s *SecretService) addPromptMatch(prompt dbus.ObjectPath) error {
+	rule := fmt.Sprintf("type='signal',interface='%s',member='Completed',path='%s'", promptInterface, prompt)
+	return s.conn.BusObject().Call("org.freedesktop.DBus.AddMatch", NilFlags, rule).Store()
+}
+
+func (s *SecretService) removePromptMatch(prompt dbus.ObjectPath) error {
+	rule := fmt.Sprintf("type='signal',interface='%s',member='Completed',path='%s'", promptInterface, prompt)
+	return s.conn.BusObject().Call("org.freedesktop.DBus.RemoveMatch", NilFlags, rule).Store()
+}
+
 // PromptAndWait is NOT thread-safe.
 func (s *SecretService) PromptAndWait(prompt dbus.ObjectPath) (paths *dbus.Variant, err error) {
 	if prompt == NullPrompt {
 		return nil, nil
 	}
+
+	if err := s.addPromptMatch(prompt); err != nil {
+		return nil, errors.Wrap(err, "failed to subscribe to prompt completion")
+	}
+	defer func() {
+		_ = s.removePromptMatch(prompt)
+	}()
+
 	call := s.Obj(prompt).Call("org.freedesktop.Secret.Prompt.Prompt", NilFlags, "Keyring Prompt")
 	if call.Err != nil {
-		return nil, errors.Wrap(err, "failed to prompt")
+		return nil, errors.Wrap(call.Err, "failed to prompt")
 	}
 	for {
 		var result PromptCompletedResult
 		select {
 		case signal := <-s.signalCh:
-			if signal.Name != "org.freedesktop.Secret.Prompt.Completed" {
+			if signal.Path != prompt || signal.Name != promptInterface+".Completed" {
 				continue
 			}
 			err = dbus.Store(signal.Body, &result.Dismissed, &result.Paths)
@@ -283,6 +384,21 @@ func NewSecretProperties(label string, attributes map[string]string) map[string]
 	}
 }
 
+// Close closes the session on the secretservice daemon. It is a no-op if
+// the session was never successfully opened.
+func (session *Session) Close() error {
+	if session == nil || session.service == nil {
+		return nil
+	}
+	err := session.service.Obj(session.Path).
+		Call("org.freedesktop.Secret.Session.Close", NilFlags).
+		Store()
+	if err != nil {
+		return errors.Wrap(err, "failed to close secretservice session")
+	}
+	return nil
+}
+
 func (session *Session) NewSecret(secretBytes []byte) (Secret, error) {
 	switch session.Mode {
 	case AuthenticationPlain:
@@ -313,6 +429,7 @@ func main2() error {
 	if err != nil {
 		return err
 	}
+	defer srv.Close()
 	session, err := srv.OpenSession(AuthenticationPlain)
 	if err != nil {
 		return err
@@ -361,12 +478,3 @@ func main2() error {
 // 		panic(fmt.Sprintf("%+v\n", err))
 // 	}
 // }
-
-// TODO does default collection always exist..? (no)
-// TODO fallback if no gnome-keyring EXPL
-// upgrade path...?
-// if there are more than 1, what should we do? just delete all of them and fail?
-// TODO dh ietf
-// TODO replacebehavior type
-// TODO close session
-// TODO use different collection..
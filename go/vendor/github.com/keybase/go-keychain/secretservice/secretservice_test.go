@@ -0,0 +1,82 @@
+package secretservice
+
+import (
+	"bytes"
+	"testing"
+
+	dbus "github.com/guelfey/go.dbus"
+)
+
+// TestApplyOpenSessionResponseDerivesMatchingAESKey drives the exact
+// response-decoding wiring OpenSession uses -- standing in for the D-Bus
+// peer by handing it the kind of dbus.Variant a real secretservice daemon
+// would reply with -- and checks that the client ends up agreeing with an
+// independently-derived server-side key. This is the path a past version
+// of this code got wrong by decoding the peer's public value with
+// UnmarshalText instead of SetBytes.
+func TestApplyOpenSessionResponseDerivesMatchingAESKey(t *testing.T) {
+	group := RFC2409SecondOakleyGroup()
+
+	clientPrivate, _, err := group.NewKeypair()
+	if err != nil {
+		t.Fatalf("client NewKeypair: %v", err)
+	}
+	serverPrivate, serverPublic, err := group.NewKeypair()
+	if err != nil {
+		t.Fatalf("server NewKeypair: %v", err)
+	}
+	expectedKey, err := group.KeygenHKDFSHA256AES128(serverPublic, clientPrivate)
+	if err != nil {
+		t.Fatalf("expected KeygenHKDFSHA256AES128: %v", err)
+	}
+
+	session := &Session{
+		Mode:    AuthenticationDHIETF1024SHA256AES128CBCPKCS7,
+		Private: clientPrivate,
+	}
+	response := dbus.MakeVariant(serverPublic.Bytes()) // math/big.Int.Bytes is big endian, as the daemon sends it
+	if err := session.applyOpenSessionResponse("/org/freedesktop/secrets/session/s0", response); err != nil {
+		t.Fatalf("applyOpenSessionResponse: %v", err)
+	}
+
+	if session.Path != "/org/freedesktop/secrets/session/s0" {
+		t.Errorf("session.Path = %q, want %q", session.Path, "/org/freedesktop/secrets/session/s0")
+	}
+	if !bytes.Equal(session.AESKey, expectedKey) {
+		t.Errorf("session.AESKey = %x, want %x (client and server disagree on the shared key)", session.AESKey, expectedKey)
+	}
+}
+
+// TestDecodeAndDecryptSecretRoundTrip feeds decodeAndDecryptSecret the same
+// shape of reply GetSecret's D-Bus call would Store into secretI, covering
+// both authentication modes without a live D-Bus connection.
+func TestDecodeAndDecryptSecretRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x24}, 16)
+	plaintext := []byte("hunter2")
+
+	iv, ciphertext, err := UnauthenticatedAESCBCEncrypt(plaintext, key)
+	if err != nil {
+		t.Fatalf("UnauthenticatedAESCBCEncrypt: %v", err)
+	}
+
+	session := Session{Mode: AuthenticationDHIETF1024SHA256AES128CBCPKCS7, Path: "/session/s0", AESKey: key}
+	secretI := []interface{}{session.Path, iv, ciphertext, "text/plain"}
+
+	got, err := decodeAndDecryptSecret(secretI, session)
+	if err != nil {
+		t.Fatalf("decodeAndDecryptSecret: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("decodeAndDecryptSecret = %q, want %q", got, plaintext)
+	}
+
+	plainSession := Session{Mode: AuthenticationPlain, Path: "/session/s1"}
+	plainSecretI := []interface{}{plainSession.Path, []byte{}, plaintext, "text/plain"}
+	got, err = decodeAndDecryptSecret(plainSecretI, plainSession)
+	if err != nil {
+		t.Fatalf("decodeAndDecryptSecret (plain): %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("decodeAndDecryptSecret (plain) = %q, want %q", got, plaintext)
+	}
+}